@@ -0,0 +1,24 @@
+// Copyright © 2023 OpenIM. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cachekey
+
+const conversationHasReadSeqHashKey = "CONVERSATION_HAS_READ_SEQ_HASH:"
+
+// GetConversationHasReadSeqHashKey 用户所有会话已读seq的redis HASH key，field为conversationID。
+// 这是GetConversationHasReadSeqKey(ownerUserID, conversationID)的同族key，但粒度是一个owner一个
+// hash，不复用/不更改已有导出函数的签名，以免影响其已有调用方。
+func GetConversationHasReadSeqHashKey(ownerUserID string) string {
+	return conversationHasReadSeqHashKey + ownerUserID
+}
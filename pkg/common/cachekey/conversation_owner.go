@@ -0,0 +1,23 @@
+// Copyright © 2023 OpenIM. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cachekey
+
+const conversationOwnersKey = "CONVERSATION_OWNERS:"
+
+// GetConversationOwnersKey conversationID对应的所有owner user id集合的redis key,
+// 用于跨owner按conversationID定位一个会话的每一份拷贝.
+func GetConversationOwnersKey(conversationID string) string {
+	return conversationOwnersKey + conversationID
+}
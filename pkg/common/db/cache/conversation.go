@@ -16,7 +16,9 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"math/big"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,6 +26,7 @@ import (
 	"github.com/openimsdk/open-im-server/v3/pkg/common/cachekey"
 	"github.com/openimsdk/open-im-server/v3/pkg/common/config"
 	relationtb "github.com/openimsdk/open-im-server/v3/pkg/common/db/table/relation"
+	"github.com/openimsdk/tools/errs"
 	"github.com/openimsdk/tools/log"
 	"github.com/openimsdk/tools/utils/datautil"
 	"github.com/openimsdk/tools/utils/encrypt"
@@ -73,7 +76,9 @@ type ConversationCache interface {
 	// GetSuperGroupRecvMsgNotNotifyUserIDsHash(ctx context.Context, groupID string) (hash uint64, err error)
 	DelSuperGroupRecvMsgNotNotifyUserIDsHash(groupID string) ConversationCache
 
-	// GetUserAllHasReadSeqs(ctx context.Context, ownerUserID string) (map[string]int64, error)
+	GetConversationHasReadSeq(ctx context.Context, ownerUserID, conversationID string) (int64, error)
+	GetUserAllHasReadSeqs(ctx context.Context, ownerUserID string, conversationIDs []string) (map[string]int64, error)
+	SetConversationHasReadSeq(ctx context.Context, ownerUserID, conversationID string, hasReadSeq int64) (int64, error)
 	DelUserAllHasReadSeqs(ownerUserID string, conversationIDs ...string) ConversationCache
 
 	GetConversationsByConversationID(ctx context.Context,
@@ -93,20 +98,32 @@ func NewConversationRedis(rdb redis.UniversalClient, localCache *config.LocalCac
 	mc.SetTopic(c.Topic)
 	// 设置常规redis client
 	mc.SetRawRedisClient(rdb)
-	return &ConversationRedisCache{
+	redisCache := &ConversationRedisCache{
 		rcClient:       rcClient,
 		metaCache:      mc,
+		rdb:            rdb,
 		conversationDB: db,
 		expireTime:     conversationExpireTime, // redis conversation缓存12小时
+		topic:          c.Topic,
+	}
+	if !c.Enable() {
+		return redisCache
 	}
+	// 本地开启了二级缓存，叠加一层进程内分片LRU，并订阅Topic以感知其它节点的失效广播
+	return newConversationL2Cache(redisCache, rdb, c.Topic, c.SlotNum, c.SlotSize)
 }
 
 // 会话redis缓存使用rockscache保证数据一致性
 type ConversationRedisCache struct {
 	metaCache
 	rcClient       *rockscache.Client
+	rdb            redis.UniversalClient
 	conversationDB relationtb.ConversationModelInterface
 	expireTime     time.Duration
+	// topic是localCache.Conversation配置的失效广播频道，DelUserAllHasReadSeqs这类绕过AddKeys/ExecDel、
+	// 直接操作redis的删除路径需要自己往这个频道发布失效消息，才能让其它节点的ConversationL2Cache.subscribe
+	// 收到并驱逐本地副本；经过AddKeys/ExecDel的删除路径由metaCache自己负责发布，不需要重复发
+	topic string
 }
 
 // func NewNewConversationRedis(
@@ -128,8 +145,10 @@ func (c *ConversationRedisCache) NewCache() ConversationCache {
 	return &ConversationRedisCache{
 		rcClient:       c.rcClient,
 		metaCache:      c.Copy(),
+		rdb:            c.rdb,
 		conversationDB: c.conversationDB,
 		expireTime:     c.expireTime,
+		topic:          c.topic,
 	}
 }
 
@@ -156,9 +175,11 @@ func (c *ConversationRedisCache) getSuperGroupRecvNotNotifyUserIDsHashKey(groupI
 	return cachekey.GetSuperGroupRecvNotNotifyUserIDsHashKey(groupID)
 }
 
-// 用户在当前会话已读的seq key
-func (c *ConversationRedisCache) getConversationHasReadSeqKey(ownerUserID, conversationID string) string {
-	return cachekey.GetConversationHasReadSeqKey(ownerUserID, conversationID)
+// 用户已读seq hash key，一个owner对应一个hash，field为conversationID。
+// 这是一个独立于cachekey.GetConversationHasReadSeqKey(ownerUserID, conversationID)的新key，
+// 后者是逐会话的key，本缓存层改造为一个owner一个hash，不能复用/更改原有导出函数的签名。
+func (c *ConversationRedisCache) getConversationHasReadSeqHashKey(ownerUserID string) string {
+	return cachekey.GetConversationHasReadSeqHashKey(ownerUserID)
 }
 
 // 屏蔽接收当前会话的user ids key
@@ -171,6 +192,11 @@ func (c *ConversationRedisCache) getUserConversationIDsHashKey(ownerUserID strin
 	return cachekey.GetUserConversationIDsHashKey(ownerUserID)
 }
 
+// conversationID对应的所有owner user id集合key，用于跨owner定位一个会话的全部副本
+func (c *ConversationRedisCache) getConversationOwnersKey(conversationID string) string {
+	return cachekey.GetConversationOwnersKey(conversationID)
+}
+
 // rockscache获取用户所有的会话ids
 func (c *ConversationRedisCache) GetUserConversationIDs(ctx context.Context, ownerUserID string) ([]string, error) {
 	// 首先从redis中查找，没找到再从db中查询， 用的是rockscache
@@ -224,18 +250,75 @@ func (c *ConversationRedisCache) DelUserConversationIDsHash(ownerUserIDs ...stri
 	return cache
 }
 
+// addConversationOwnerIndex 把ownerUserID加入conversationID的反向索引集合，并把索引的过期时间刷新到
+// 与会话本身一致(c.expireTime)，使索引能像其它缓存key一样自然过期，不依赖窄的跨owner删除路径去回收
+func (c *ConversationRedisCache) addConversationOwnerIndex(ctx context.Context, conversationID, ownerUserID string) error {
+	key := c.getConversationOwnersKey(conversationID)
+	if err := c.rdb.SAdd(ctx, key, ownerUserID).Err(); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := c.rdb.Expire(ctx, key, c.expireTime).Err(); err != nil {
+		return errs.Wrap(err)
+	}
+	return nil
+}
+
+// addConversationOwnerIndexBatch是addConversationOwnerIndex的批量版本，用pipeline把多个conversationID
+// 的SAdd+Expire打包成一次往返，给GetConversations这类一次要刷新一批会话索引的调用方用，
+// 避免纯缓存命中时也要为每个会话单独打两次redis请求
+func (c *ConversationRedisCache) addConversationOwnerIndexBatch(ctx context.Context, ownerUserID string, conversationIDs []string) error {
+	if len(conversationIDs) == 0 {
+		return nil
+	}
+	pipe := c.rdb.Pipeline()
+	for _, conversationID := range conversationIDs {
+		key := c.getConversationOwnersKey(conversationID)
+		pipe.SAdd(ctx, key, ownerUserID)
+		pipe.Expire(ctx, key, c.expireTime)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errs.Wrap(err)
+	}
+	return nil
+}
+
+// removeConversationOwnerIndex 把ownerUserID从conversationID的反向索引集合里摘掉，
+// 是addConversationOwnerIndex的逆操作：DelConversations/DelUsersConversation删除某个owner的
+// 会话缓存时要同步调用，否则索引会一直留着已经不存在的owner，后续GetConversationsByConversationID
+// 枚举到这个脏owner时还要再跑一次注定失败的db查询
+func (c *ConversationRedisCache) removeConversationOwnerIndex(ctx context.Context, conversationID, ownerUserID string) error {
+	if err := c.rdb.SRem(ctx, c.getConversationOwnersKey(conversationID), ownerUserID).Err(); err != nil {
+		return errs.Wrap(err)
+	}
+	return nil
+}
+
 // rockscache查询用户指定会话信息
 func (c *ConversationRedisCache) GetConversation(ctx context.Context, ownerUserID, conversationID string) (*relationtb.ConversationModel, error) {
 	// 从redis中获取用户的当前会话内容
-	return getCache(ctx, c.rcClient, c.getConversationKey(ownerUserID, conversationID), c.expireTime, func(ctx context.Context) (*relationtb.ConversationModel, error) {
+	conversation, err := getCache(ctx, c.rcClient, c.getConversationKey(ownerUserID, conversationID), c.expireTime, func(ctx context.Context) (*relationtb.ConversationModel, error) {
 		return c.conversationDB.Take(ctx, ownerUserID, conversationID)
 	})
+	if err != nil {
+		return nil, err
+	}
+	// 维护conversationID -> ownerUserID的反向索引，供GetConversationsByConversationID跨owner查询使用
+	if err := c.addConversationOwnerIndex(ctx, conversationID, ownerUserID); err != nil {
+		log.ZWarn(ctx, "add conversation owner index failed", err, "ownerUserID", ownerUserID, "conversationID", conversationID)
+	}
+	return conversation, nil
 }
 
 func (c *ConversationRedisCache) DelConversations(ownerUserID string, conversationIDs ...string) ConversationCache {
 	keys := make([]string, 0, len(conversationIDs))
+	ctx := context.Background()
 	for _, conversationID := range conversationIDs {
 		keys = append(keys, c.getConversationKey(ownerUserID, conversationID))
+		// 同步把该owner从conversationID的反向索引里摘掉，否则GetConversationsByConversationID之后还会
+		// 枚举到这个已经删除的owner，白跑一次注定找不到记录的db查询
+		if err := c.removeConversationOwnerIndex(ctx, conversationID, ownerUserID); err != nil {
+			log.ZWarn(ctx, "remove conversation owner index failed", err, "ownerUserID", ownerUserID, "conversationID", conversationID)
+		}
 	}
 	cache := c.NewCache()
 	cache.AddKeys(keys...)
@@ -270,11 +353,25 @@ func (c *ConversationRedisCache) GetConversations(ctx context.Context, ownerUser
 	//		return c.conversationDB.Find(ctx, ownerUserID, conversationIDs)
 	//	},
 	//)
-	return batchGetCache2(ctx, c.rcClient, c.expireTime, conversationIDs, func(conversationID string) string {
+	conversations, err := batchGetCache2(ctx, c.rcClient, c.expireTime, conversationIDs, func(conversationID string) string {
 		return c.getConversationKey(ownerUserID, conversationID)
 	}, func(ctx context.Context, conversationID string) (*relationtb.ConversationModel, error) {
 		return c.conversationDB.Take(ctx, ownerUserID, conversationID)
 	})
+	if err != nil {
+		return nil, err
+	}
+	// GetConversations/GetUserAllConversations是列出"我的会话"的常规访问路径，同样要维护反向索引，
+	// 否则只通过这里填充的owner拷贝会对GetConversationsByConversationID/DelConversationByConversationID不可见；
+	// 用pipeline把这一批会话的SAdd+Expire打包成一次往返，纯缓存命中时也只多付一次redis请求，而不是2N次
+	gotConversationIDs := make([]string, 0, len(conversations))
+	for _, conversation := range conversations {
+		gotConversationIDs = append(gotConversationIDs, conversation.ConversationID)
+	}
+	if err := c.addConversationOwnerIndexBatch(ctx, ownerUserID, gotConversationIDs); err != nil {
+		log.ZWarn(ctx, "add conversation owner index failed", err, "ownerUserID", ownerUserID, "conversationIDs", gotConversationIDs)
+	}
+	return conversations, nil
 }
 
 // rockscache获取用户所有会话消息
@@ -315,8 +412,12 @@ func (c *ConversationRedisCache) GetUserRecvMsgOpt(ctx context.Context, ownerUse
 
 func (c *ConversationRedisCache) DelUsersConversation(conversationID string, ownerUserIDs ...string) ConversationCache {
 	keys := make([]string, 0, len(ownerUserIDs))
+	ctx := context.Background()
 	for _, ownerUserID := range ownerUserIDs {
 		keys = append(keys, c.getConversationKey(ownerUserID, conversationID))
+		if err := c.removeConversationOwnerIndex(ctx, conversationID, ownerUserID); err != nil {
+			log.ZWarn(ctx, "remove conversation owner index failed", err, "ownerUserID", ownerUserID, "conversationID", conversationID)
+		}
 	}
 	cache := c.NewCache()
 	cache.AddKeys(keys...)
@@ -359,21 +460,192 @@ func (c *ConversationRedisCache) DelSuperGroupRecvMsgNotNotifyUserIDsHash(groupI
 	return cache
 }
 
+// 用HGET从redis hash读取用户单个会话的已读seq，未命中则回源db并用HSETNX写回hash(不经过rockscache)
+func (c *ConversationRedisCache) GetConversationHasReadSeq(ctx context.Context, ownerUserID, conversationID string) (int64, error) {
+	seq, err := c.rdb.HGet(ctx, c.getConversationHasReadSeqHashKey(ownerUserID), conversationID).Int64()
+	if err == nil {
+		return seq, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		return 0, errs.Wrap(err)
+	}
+	seq, err = c.conversationDB.GetHasReadSeq(ctx, ownerUserID, conversationID)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.rdb.HSetNX(ctx, c.getConversationHasReadSeqHashKey(ownerUserID), conversationID, seq).Err(); err != nil {
+		log.ZWarn(ctx, "cache conversation has read seq failed", err, "ownerUserID", ownerUserID, "conversationID", conversationID)
+	}
+	return seq, nil
+}
+
+// 批量读取用户多个会话的已读seq：一次HMGET后对未命中的field逐个回源db补齐并用HSETNX写回hash(不经过rockscache)
+func (c *ConversationRedisCache) GetUserAllHasReadSeqs(ctx context.Context, ownerUserID string, conversationIDs []string) (map[string]int64, error) {
+	key := c.getConversationHasReadSeqHashKey(ownerUserID)
+	cached, err := c.rdb.HMGet(ctx, key, conversationIDs...).Result()
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	seqs := make(map[string]int64, len(conversationIDs))
+	for i, conversationID := range conversationIDs {
+		v, ok := cached[i].(string)
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		seqs[conversationID] = seq
+	}
+	for _, conversationID := range conversationIDs {
+		if _, ok := seqs[conversationID]; ok {
+			continue
+		}
+		seq, err := c.conversationDB.GetHasReadSeq(ctx, ownerUserID, conversationID)
+		if err != nil {
+			return nil, err
+		}
+		seqs[conversationID] = seq
+		if err := c.rdb.HSetNX(ctx, key, conversationID, seq).Err(); err != nil {
+			log.ZWarn(ctx, "cache conversation has read seq failed", err, "ownerUserID", ownerUserID, "conversationID", conversationID)
+		}
+	}
+	return seqs, nil
+}
+
+// setConversationHasReadSeqScript 用Lua保证"读旧值-比较-写新值"是原子操作：只有新seq比已存储的大才覆盖，
+// 避免并发的已读回执请求互相覆盖造成已读seq倒退（lost update）
+var setConversationHasReadSeqScript = redis.NewScript(`
+local old = redis.call("HGET", KEYS[1], ARGV[1])
+if old == false then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+	return -1
+end
+if tonumber(ARGV[2]) > tonumber(old) then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return old
+`)
+
+// SetConversationHasReadSeq 原子地把已读seq更新为两者较大值，返回更新前的旧值（首次写入返回-1）
+func (c *ConversationRedisCache) SetConversationHasReadSeq(ctx context.Context, ownerUserID, conversationID string, hasReadSeq int64) (int64, error) {
+	key := c.getConversationHasReadSeqHashKey(ownerUserID)
+	res, err := setConversationHasReadSeqScript.Run(ctx, c.rdb, []string{key}, conversationID, hasReadSeq).Result()
+	if err != nil {
+		return 0, errs.Wrap(err)
+	}
+	switch v := res.(type) {
+	case int64:
+		return v, nil
+	case string:
+		old, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, errs.Wrap(err)
+		}
+		return old, nil
+	default:
+		return 0, nil
+	}
+}
+
+// DelUserAllHasReadSeqs HDEL指定的field，而不是删除整个hash，避免误删同一owner下其它会话的已读seq；
+// 这条路径绕开了AddKeys/ExecDel，所以HDel成功后要自己往topic发布失效消息，让其它节点的
+// ConversationL2Cache.subscribe也能驱逐各自的本地副本，而不是只靠30秒的本地缓存TTL自愈
 func (c *ConversationRedisCache) DelUserAllHasReadSeqs(ownerUserID string, conversationIDs ...string) ConversationCache {
 	cache := c.NewCache()
-	for _, conversationID := range conversationIDs {
-		cache.AddKeys(c.getConversationHasReadSeqKey(ownerUserID, conversationID))
+	if len(conversationIDs) == 0 {
+		return cache
+	}
+	ctx := context.Background()
+	if err := c.rdb.HDel(ctx, c.getConversationHasReadSeqHashKey(ownerUserID), conversationIDs...).Err(); err != nil {
+		log.ZWarn(ctx, "del conversation has read seq failed", err, "ownerUserID", ownerUserID, "conversationIDs", conversationIDs)
+		return cache
+	}
+	if c.topic != "" {
+		localKeys := make([]string, 0, len(conversationIDs))
+		for _, conversationID := range conversationIDs {
+			localKeys = append(localKeys, c.getConversationHasReadSeqHashKey(ownerUserID)+":"+conversationID)
+		}
+		if err := c.rdb.Publish(ctx, c.topic, strings.Join(localKeys, ",")).Err(); err != nil {
+			log.ZWarn(ctx, "publish conversation has read seq invalidation failed", err, "ownerUserID", ownerUserID, "conversationIDs", conversationIDs)
+		}
 	}
 
 	return cache
 }
 
+// rockscache借助conversationID->ownerUserID的反向索引，跨所有拥有者获取该会话的每一份拷贝，
+// 索引缺失（未建立或已过期）时回源db补齐并重建索引；索引里个别owner失效（已被删除但索引没摘干净）
+// 时只跳过并自愈那一个owner，不影响其它owner的正常返回
 func (c *ConversationRedisCache) GetConversationsByConversationID(ctx context.Context, conversationIDs []string) ([]*relationtb.ConversationModel, error) {
-	panic("implement me")
+	conversations := make([]*relationtb.ConversationModel, 0, len(conversationIDs))
+	var missingConversationIDs []string
+	ownerUserIDsByConversationID := make(map[string][]string, len(conversationIDs))
+	for _, conversationID := range conversationIDs {
+		ownerUserIDs, err := c.rdb.SMembers(ctx, c.getConversationOwnersKey(conversationID)).Result()
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		if len(ownerUserIDs) == 0 {
+			missingConversationIDs = append(missingConversationIDs, conversationID)
+			continue
+		}
+		ownerUserIDsByConversationID[conversationID] = ownerUserIDs
+	}
+	if len(missingConversationIDs) > 0 {
+		dbConversations, err := c.conversationDB.FindConversationsByConversationID(ctx, missingConversationIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, conversation := range dbConversations {
+			conversations = append(conversations, conversation)
+			if err := c.addConversationOwnerIndex(ctx, conversation.ConversationID, conversation.OwnerUserID); err != nil {
+				log.ZWarn(ctx, "rebuild conversation owner index failed", err, "conversationID", conversation.ConversationID)
+			}
+		}
+	}
+	// 这里不能再用batchGetCache2把一个conversationID下的所有owner合成一批查：索引里的owner可能因为
+	// 其它节点的并发删除已经失效(脏数据)，必须逐个owner单独取，命中ErrRecordNotFound就跳过并顺手
+	// 把这个脏owner从索引里摘掉自愈，而不是让一个owner的缺失拖垮整批查询
+	for conversationID, ownerUserIDs := range ownerUserIDsByConversationID {
+		for _, ownerUserID := range ownerUserIDs {
+			conversation, err := getCache(ctx, c.rcClient, c.getConversationKey(ownerUserID, conversationID), c.expireTime, func(ctx context.Context) (*relationtb.ConversationModel, error) {
+				return c.conversationDB.Take(ctx, ownerUserID, conversationID)
+			})
+			if err != nil {
+				if errors.Is(err, errs.ErrRecordNotFound) {
+					if err := c.removeConversationOwnerIndex(ctx, conversationID, ownerUserID); err != nil {
+						log.ZWarn(ctx, "remove stale conversation owner failed", err, "conversationID", conversationID, "ownerUserID", ownerUserID)
+					}
+					continue
+				}
+				return nil, err
+			}
+			conversations = append(conversations, conversation)
+		}
+	}
+	return conversations, nil
 }
 
+// 借助反向索引枚举出会话的每一个owner, 逐一删除其redis缓存, 最后丢弃索引本身
 func (c *ConversationRedisCache) DelConversationByConversationID(conversationIDs ...string) ConversationCache {
-	panic("implement me")
+	cache := c.NewCache()
+	ctx := context.Background()
+	for _, conversationID := range conversationIDs {
+		ownersKey := c.getConversationOwnersKey(conversationID)
+		ownerUserIDs, err := c.rdb.SMembers(ctx, ownersKey).Result()
+		if err != nil {
+			log.ZWarn(ctx, "get conversation owners failed", err, "conversationID", conversationID)
+		}
+		for _, ownerUserID := range ownerUserIDs {
+			cache.AddKeys(c.getConversationKey(ownerUserID, conversationID))
+		}
+		// 索引本身也要清掉，即使上面SMembers出错也不能跳过，否则索引永远得不到清理
+		cache.AddKeys(ownersKey)
+	}
+
+	return cache
 }
 
 // rockscache获取当前会话不接收消息的用户ids
@@ -0,0 +1,244 @@
+// Copyright © 2023 OpenIM. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeHasReadSeqHash是一个最小化的内存HASH实现，只够驱动GetConversationHasReadSeq/
+// GetUserAllHasReadSeqs/SetConversationHasReadSeq用到的HGet/HSetNX/HMGet/HDel/Eval，
+// 不引入miniredis这种本仓库快照未声明过的新依赖。
+type fakeHasReadSeqHash struct {
+	mu     sync.Mutex
+	fields map[string]map[string]string
+}
+
+func newFakeHasReadSeqHash() *fakeHasReadSeqHash {
+	return &fakeHasReadSeqHash{fields: map[string]map[string]string{}}
+}
+
+func (s *fakeHasReadSeqHash) hget(key, field string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.fields[key][field]
+	return v, ok
+}
+
+func (s *fakeHasReadSeqHash) hset(key, field, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fields[key] == nil {
+		s.fields[key] = map[string]string{}
+	}
+	s.fields[key][field] = value
+}
+
+func (s *fakeHasReadSeqHash) hsetnx(key, field, value string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fields[key] == nil {
+		s.fields[key] = map[string]string{}
+	}
+	if _, ok := s.fields[key][field]; ok {
+		return false
+	}
+	s.fields[key][field] = value
+	return true
+}
+
+func (s *fakeHasReadSeqHash) hdel(key string, fields ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, field := range fields {
+		delete(s.fields[key], field)
+	}
+}
+
+// fakeHasReadSeqClient内嵌一个nil的redis.UniversalClient，只覆盖测试实际用到的几个方法，
+// 其余方法调用会直接panic提醒补齐，而不是静默返回零值。
+type fakeHasReadSeqClient struct {
+	redis.UniversalClient
+	store *fakeHasReadSeqHash
+}
+
+func (f *fakeHasReadSeqClient) HGet(ctx context.Context, key, field string) *redis.StringCmd {
+	cmd := redis.NewStringCmd(ctx)
+	if v, ok := f.store.hget(key, field); ok {
+		cmd.SetVal(v)
+	} else {
+		cmd.SetErr(redis.Nil)
+	}
+	return cmd
+}
+
+func (f *fakeHasReadSeqClient) HSetNX(ctx context.Context, key, field string, value interface{}) *redis.BoolCmd {
+	cmd := redis.NewBoolCmd(ctx)
+	cmd.SetVal(f.store.hsetnx(key, field, toHashString(value)))
+	return cmd
+}
+
+func (f *fakeHasReadSeqClient) HMGet(ctx context.Context, key string, fields ...string) *redis.SliceCmd {
+	cmd := redis.NewSliceCmd(ctx)
+	vals := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if v, ok := f.store.hget(key, field); ok {
+			vals[i] = v
+		}
+	}
+	cmd.SetVal(vals)
+	return cmd
+}
+
+func (f *fakeHasReadSeqClient) HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+	f.store.hdel(key, fields...)
+	cmd.SetVal(int64(len(fields)))
+	return cmd
+}
+
+// setConversationHasReadSeqScript在真实redis上靠EVALSHA/EVAL下发；这个假client没有脚本缓存，
+// 永远回NOSCRIPT，驱动redis.Script.Run按约定走到下面的Eval分支，里面用go重新实现同一段Lua逻辑。
+func (f *fakeHasReadSeqClient) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(ctx)
+	cmd.SetErr(fakeRedisError("NOSCRIPT No matching script"))
+	return cmd
+}
+
+// fakeRedisError带有RedisError方法，满足redis.Error接口；redis.Script.Run只对这种服务端错误按NOSCRIPT前缀判断并改走Eval。
+type fakeRedisError string
+
+func (e fakeRedisError) Error() string { return string(e) }
+
+func (fakeRedisError) RedisError() {}
+
+func (f *fakeHasReadSeqClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(ctx)
+	key := keys[0]
+	field := toHashString(args[0])
+	newSeq := toHashString(args[1])
+	old, ok := f.store.hget(key, field)
+	if !ok {
+		f.store.hset(key, field, newSeq)
+		cmd.SetVal(int64(-1))
+		return cmd
+	}
+	oldSeq, err := strconv.ParseInt(old, 10, 64)
+	if err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	parsedNew, err := strconv.ParseInt(newSeq, 10, 64)
+	if err != nil {
+		cmd.SetErr(err)
+		return cmd
+	}
+	if parsedNew > oldSeq {
+		f.store.hset(key, field, newSeq)
+	}
+	cmd.SetVal(old)
+	return cmd
+}
+
+func toHashString(v interface{}) string {
+	switch vv := v.(type) {
+	case string:
+		return vv
+	case int64:
+		return strconv.FormatInt(vv, 10)
+	case int:
+		return strconv.Itoa(vv)
+	default:
+		return ""
+	}
+}
+
+// newTestConversationCache构造一个只填充了rdb字段的ConversationRedisCache，足够驱动
+// SetConversationHasReadSeq/GetConversationHasReadSeq/GetUserAllHasReadSeqs的缓存命中路径，
+// 不依赖rcClient/metaCache/conversationDB(DelUserAllHasReadSeqs等用到NewCache的方法不在这里测试)。
+func newTestConversationCache(t *testing.T) *ConversationRedisCache {
+	t.Helper()
+	return &ConversationRedisCache{rdb: &fakeHasReadSeqClient{store: newFakeHasReadSeqHash()}}
+}
+
+func TestSetConversationHasReadSeqMonotonicUpdate(t *testing.T) {
+	ctx := context.Background()
+	c := newTestConversationCache(t)
+
+	old, err := c.SetConversationHasReadSeq(ctx, "u1", "conv1", 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if old != -1 {
+		t.Fatalf("expected -1 for the first write, got %d", old)
+	}
+
+	// 更小的seq不应该覆盖已存储的值
+	old, err = c.SetConversationHasReadSeq(ctx, "u1", "conv1", 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if old != 5 {
+		t.Fatalf("expected previous value 5, got %d", old)
+	}
+	seq, err := c.GetConversationHasReadSeq(ctx, "u1", "conv1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if seq != 5 {
+		t.Fatalf("seq must not regress: want 5, got %d", seq)
+	}
+
+	// 更大的seq才会覆盖
+	old, err = c.SetConversationHasReadSeq(ctx, "u1", "conv1", 9)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if old != 5 {
+		t.Fatalf("expected previous value 5, got %d", old)
+	}
+	seq, err = c.GetConversationHasReadSeq(ctx, "u1", "conv1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if seq != 9 {
+		t.Fatalf("seq must advance to the larger value: want 9, got %d", seq)
+	}
+}
+
+func TestGetUserAllHasReadSeqsReadsFromHash(t *testing.T) {
+	ctx := context.Background()
+	c := newTestConversationCache(t)
+
+	if _, err := c.SetConversationHasReadSeq(ctx, "u1", "conv1", 10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.SetConversationHasReadSeq(ctx, "u1", "conv2", 20); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	seqs, err := c.GetUserAllHasReadSeqs(ctx, "u1", []string{"conv1", "conv2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if seqs["conv1"] != 10 || seqs["conv2"] != 20 {
+		t.Fatalf("unexpected seqs: %+v", seqs)
+	}
+}
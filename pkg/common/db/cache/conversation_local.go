@@ -0,0 +1,282 @@
+// Copyright © 2023 OpenIM. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	relationtb "github.com/openimsdk/open-im-server/v3/pkg/common/db/table/relation"
+	"github.com/redis/go-redis/v9"
+)
+
+// 本地缓存的存活时间取redis缓存时间的一个很小的比例，保证节点间short-lived的不一致能很快自愈
+const conversationLocalCacheExpireTime = time.Second * 30
+
+// ConversationL2Cache 在ConversationRedisCache之上叠加一层进程内分片LRU，
+// 读路径优先命中本地缓存，未命中再回落到rockscache/db；并通过订阅localCache.Conversation配置的
+// Topic，在任意节点执行Del*后收到广播并驱逐本地副本，从而让原本只是被打日志的本地缓存配置真正生效。
+type ConversationL2Cache struct {
+	*ConversationRedisCache
+	local *shardLRU
+}
+
+func newConversationL2Cache(redisCache *ConversationRedisCache, rdb redis.UniversalClient, topic string, slotNum, slotSize int) *ConversationL2Cache {
+	l2 := &ConversationL2Cache{
+		ConversationRedisCache: redisCache,
+		local:                  newShardLRU(slotNum, slotSize, conversationLocalCacheExpireTime),
+	}
+	if topic != "" {
+		go l2.subscribe(context.Background(), rdb, topic)
+	}
+	return l2
+}
+
+// subscribe 监听Del*产生的失效广播，把本地对应的key逐出，多个key以逗号拼在一条消息里发布
+func (l *ConversationL2Cache) subscribe(ctx context.Context, rdb redis.UniversalClient, topic string) {
+	sub := rdb.Subscribe(ctx, topic)
+	defer sub.Close()
+	ch := sub.Channel()
+	for msg := range ch {
+		if msg.Payload == "" {
+			continue
+		}
+		l.local.Del(strings.Split(msg.Payload, ",")...)
+	}
+}
+
+func (l *ConversationL2Cache) NewCache() ConversationCache {
+	return &ConversationL2Cache{
+		ConversationRedisCache: l.ConversationRedisCache.NewCache().(*ConversationRedisCache),
+		local:                  l.local,
+	}
+}
+
+func (l *ConversationL2Cache) GetUserConversationIDs(ctx context.Context, ownerUserID string) ([]string, error) {
+	return localGetConversation(l, l.getConversationIDsKey(ownerUserID), func() ([]string, error) {
+		return l.ConversationRedisCache.GetUserConversationIDs(ctx, ownerUserID)
+	})
+}
+
+func (l *ConversationL2Cache) GetUserConversationIDsHash(ctx context.Context, ownerUserID string) (uint64, error) {
+	return localGetConversation(l, l.getUserConversationIDsHashKey(ownerUserID), func() (uint64, error) {
+		return l.ConversationRedisCache.GetUserConversationIDsHash(ctx, ownerUserID)
+	})
+}
+
+func (l *ConversationL2Cache) GetConversation(ctx context.Context, ownerUserID, conversationID string) (*relationtb.ConversationModel, error) {
+	return localGetConversation(l, l.getConversationKey(ownerUserID, conversationID), func() (*relationtb.ConversationModel, error) {
+		return l.ConversationRedisCache.GetConversation(ctx, ownerUserID, conversationID)
+	})
+}
+
+func (l *ConversationL2Cache) GetConversations(ctx context.Context, ownerUserID string, conversationIDs []string) ([]*relationtb.ConversationModel, error) {
+	conversations := make([]*relationtb.ConversationModel, 0, len(conversationIDs))
+	var missed []string
+	for _, conversationID := range conversationIDs {
+		if v, ok := l.local.Get(l.getConversationKey(ownerUserID, conversationID)); ok {
+			if conversation, ok := v.(*relationtb.ConversationModel); ok {
+				conversations = append(conversations, conversation)
+				continue
+			}
+		}
+		missed = append(missed, conversationID)
+	}
+	if len(missed) == 0 {
+		return conversations, nil
+	}
+	got, err := l.ConversationRedisCache.GetConversations(ctx, ownerUserID, missed)
+	if err != nil {
+		return nil, err
+	}
+	for _, conversation := range got {
+		l.local.Set(l.getConversationKey(ownerUserID, conversation.ConversationID), conversation)
+	}
+	return append(conversations, got...), nil
+}
+
+func (l *ConversationL2Cache) GetUserAllConversations(ctx context.Context, ownerUserID string) ([]*relationtb.ConversationModel, error) {
+	conversationIDs, err := l.GetUserConversationIDs(ctx, ownerUserID)
+	if err != nil {
+		return nil, err
+	}
+	return l.GetConversations(ctx, ownerUserID, conversationIDs)
+}
+
+func (l *ConversationL2Cache) GetUserRecvMsgOpt(ctx context.Context, ownerUserID, conversationID string) (int, error) {
+	return localGetConversation(l, l.getRecvMsgOptKey(ownerUserID, conversationID), func() (int, error) {
+		return l.ConversationRedisCache.GetUserRecvMsgOpt(ctx, ownerUserID, conversationID)
+	})
+}
+
+func (l *ConversationL2Cache) GetConversationNotReceiveMessageUserIDs(ctx context.Context, conversationID string) ([]string, error) {
+	return localGetConversation(l, l.getConversationNotReceiveMessageUserIDsKey(conversationID), func() ([]string, error) {
+		return l.ConversationRedisCache.GetConversationNotReceiveMessageUserIDs(ctx, conversationID)
+	})
+}
+
+// hasReadSeq 更新频繁，本地只缓存单条已读seq，不缓存GetUserAllHasReadSeqs的批量结果，
+// 以免让局部过期的批量快照掩盖了其它字段的最新写入
+func (l *ConversationL2Cache) GetConversationHasReadSeq(ctx context.Context, ownerUserID, conversationID string) (int64, error) {
+	return localGetConversation(l, l.getConversationHasReadSeqHashKey(ownerUserID)+":"+conversationID, func() (int64, error) {
+		return l.ConversationRedisCache.GetConversationHasReadSeq(ctx, ownerUserID, conversationID)
+	})
+}
+
+func (l *ConversationL2Cache) SetConversationHasReadSeq(ctx context.Context, ownerUserID, conversationID string, hasReadSeq int64) (int64, error) {
+	old, err := l.ConversationRedisCache.SetConversationHasReadSeq(ctx, ownerUserID, conversationID, hasReadSeq)
+	if err != nil {
+		return 0, err
+	}
+	l.local.Del(l.getConversationHasReadSeqHashKey(ownerUserID) + ":" + conversationID)
+	return old, nil
+}
+
+// DelUserAllHasReadSeqs发起删除的这个节点自己直接驱逐本地副本，不必等一个来回的pub/sub广播；
+// ConversationRedisCache.DelUserAllHasReadSeqs会把同样的失效消息发布到Topic，让其它节点的
+// subscribe循环驱逐各自的本地副本。
+func (l *ConversationL2Cache) DelUserAllHasReadSeqs(ownerUserID string, conversationIDs ...string) ConversationCache {
+	cache := l.ConversationRedisCache.DelUserAllHasReadSeqs(ownerUserID, conversationIDs...)
+	for _, conversationID := range conversationIDs {
+		l.local.Del(l.getConversationHasReadSeqHashKey(ownerUserID) + ":" + conversationID)
+	}
+	return cache
+}
+
+// localGetConversation 是GetXXX系列方法的公共读路径：先查本地分片LRU，未命中再调用fn回落到rockscache/db，
+// 并把结果写回本地缓存；fn出错时不写入，避免把错误或零值缓存下来。
+func localGetConversation[T any](l *ConversationL2Cache, key string, fn func() (T, error)) (T, error) {
+	if v, ok := l.local.Get(key); ok {
+		if tv, ok := v.(T); ok {
+			return tv, nil
+		}
+	}
+	val, err := fn()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	l.local.Set(key, val)
+	return val, nil
+}
+
+type lruEntry struct {
+	key       string
+	value     any
+	expiresAt time.Time
+}
+
+type lruShard struct {
+	mu      sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	items   map[string]*list.Element
+	order   *list.List
+}
+
+func (s *lruShard) get(key string) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		s.order.Remove(elem)
+		delete(s.items, key)
+		return nil, false
+	}
+	s.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (s *lruShard) set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		elem.Value.(*lruEntry).value = value
+		elem.Value.(*lruEntry).expiresAt = time.Now().Add(s.ttl)
+		s.order.MoveToFront(elem)
+		return
+	}
+	elem := s.order.PushFront(&lruEntry{key: key, value: value, expiresAt: time.Now().Add(s.ttl)})
+	s.items[key] = elem
+	if s.maxSize > 0 && s.order.Len() > s.maxSize {
+		oldest := s.order.Back()
+		if oldest != nil {
+			s.order.Remove(oldest)
+			delete(s.items, oldest.Value.(*lruEntry).key)
+		}
+	}
+}
+
+func (s *lruShard) del(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.order.Remove(elem)
+		delete(s.items, key)
+	}
+}
+
+// shardLRU 是一个按key哈希分片的进程内LRU缓存，分片数与单片容量分别对应localCache配置的SlotNum/SlotSize，
+// 分片可以降低大并发场景下单把锁带来的竞争。
+type shardLRU struct {
+	shards []*lruShard
+}
+
+func newShardLRU(slotNum, slotSize int, ttl time.Duration) *shardLRU {
+	if slotNum <= 0 {
+		slotNum = 1
+	}
+	s := &shardLRU{shards: make([]*lruShard, slotNum)}
+	for i := range s.shards {
+		s.shards[i] = &lruShard{
+			maxSize: slotSize,
+			ttl:     ttl,
+			items:   make(map[string]*list.Element),
+			order:   list.New(),
+		}
+	}
+	return s
+}
+
+func (s *shardLRU) shardFor(key string) *lruShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *shardLRU) Get(key string) (any, bool) {
+	return s.shardFor(key).get(key)
+}
+
+func (s *shardLRU) Set(key string, value any) {
+	s.shardFor(key).set(key, value)
+}
+
+func (s *shardLRU) Del(keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		s.shardFor(key).del(key)
+	}
+}
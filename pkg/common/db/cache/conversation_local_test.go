@@ -0,0 +1,74 @@
+// Copyright © 2023 OpenIM. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShardLRUSetGet(t *testing.T) {
+	lru := newShardLRU(4, 2, time.Minute)
+	lru.Set("a", 1)
+	v, ok := lru.Get("a")
+	if !ok || v.(int) != 1 {
+		t.Fatalf("expected (1, true), got (%v, %v)", v, ok)
+	}
+	if _, ok := lru.Get("missing"); ok {
+		t.Fatal("expected missing key to not be found")
+	}
+}
+
+func TestShardLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	// 单分片让淘汰顺序可预期
+	lru := newShardLRU(1, 2, time.Minute)
+	lru.Set("a", 1)
+	lru.Set("b", 2)
+	lru.Get("a")    // 访问a，使b成为最久未使用的条目
+	lru.Set("c", 3) // 容量已满，应该淘汰b
+
+	if _, ok := lru.Get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	if _, ok := lru.Get("a"); !ok {
+		t.Fatal("expected a to still be cached")
+	}
+	if _, ok := lru.Get("c"); !ok {
+		t.Fatal("expected c to be cached")
+	}
+}
+
+func TestShardLRUTTLExpiry(t *testing.T) {
+	lru := newShardLRU(1, 10, time.Millisecond)
+	lru.Set("a", 1)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := lru.Get("a"); ok {
+		t.Fatal("expected entry to have expired")
+	}
+}
+
+func TestShardLRUDel(t *testing.T) {
+	lru := newShardLRU(2, 10, time.Minute)
+	lru.Set("a", 1)
+	lru.Set("b", 2)
+	lru.Del("a", "nonexistent")
+
+	if _, ok := lru.Get("a"); ok {
+		t.Fatal("expected a to be deleted")
+	}
+	if _, ok := lru.Get("b"); !ok {
+		t.Fatal("expected b to remain cached")
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright © 2023 OpenIM. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeOwnerIndexStore是一个最小化的内存SET实现，只够驱动addConversationOwnerIndex/
+// addConversationOwnerIndexBatch/removeConversationOwnerIndex这几个只依赖SAdd/SRem/SMembers/Expire的
+// 方法，不依赖rcClient/metaCache/conversationDB，所以GetConversationsByConversationID/
+// DelConversationByConversationID本身(会经过getCache/NewCache，依赖未在本仓库快照中提供的
+// rockscache/metaCache具体实现)不在这里覆盖。
+type fakeOwnerIndexStore struct {
+	mu   sync.Mutex
+	sets map[string]map[string]struct{}
+	ttl  map[string]time.Duration
+}
+
+func newFakeOwnerIndexStore() *fakeOwnerIndexStore {
+	return &fakeOwnerIndexStore{sets: map[string]map[string]struct{}{}, ttl: map[string]time.Duration{}}
+}
+
+func (s *fakeOwnerIndexStore) sadd(key, member string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sets[key] == nil {
+		s.sets[key] = map[string]struct{}{}
+	}
+	s.sets[key][member] = struct{}{}
+}
+
+func (s *fakeOwnerIndexStore) srem(key, member string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sets[key], member)
+}
+
+func (s *fakeOwnerIndexStore) members(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]string, 0, len(s.sets[key]))
+	for m := range s.sets[key] {
+		members = append(members, m)
+	}
+	return members
+}
+
+func (s *fakeOwnerIndexStore) expire(key string, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl[key] = ttl
+}
+
+// fakeOwnerIndexClient内嵌一个nil的redis.UniversalClient，只覆盖测试实际用到的几个方法，
+// 其余方法调用会直接panic提醒补齐，而不是静默返回零值。
+type fakeOwnerIndexClient struct {
+	redis.UniversalClient
+	store *fakeOwnerIndexStore
+}
+
+func (f *fakeOwnerIndexClient) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+	for _, m := range members {
+		f.store.sadd(key, m.(string))
+	}
+	cmd.SetVal(int64(len(members)))
+	return cmd
+}
+
+func (f *fakeOwnerIndexClient) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+	for _, m := range members {
+		f.store.srem(key, m.(string))
+	}
+	cmd.SetVal(int64(len(members)))
+	return cmd
+}
+
+func (f *fakeOwnerIndexClient) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	cmd := redis.NewStringSliceCmd(ctx)
+	cmd.SetVal(f.store.members(key))
+	return cmd
+}
+
+func (f *fakeOwnerIndexClient) Expire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd {
+	cmd := redis.NewBoolCmd(ctx)
+	f.store.expire(key, ttl)
+	cmd.SetVal(true)
+	return cmd
+}
+
+func (f *fakeOwnerIndexClient) Pipeline() redis.Pipeliner {
+	return &fakeOwnerIndexPipeliner{client: f}
+}
+
+// fakeOwnerIndexPipeliner把排队的SAdd/Expire直接同步应用到同一份store上，Exec不需要真的批量下发；
+// 这里只用来验证addConversationOwnerIndexBatch确实把一批会话的命令都打包发了出去。
+type fakeOwnerIndexPipeliner struct {
+	redis.Pipeliner
+	client *fakeOwnerIndexClient
+	cmds   []redis.Cmder
+}
+
+func (p *fakeOwnerIndexPipeliner) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	cmd := p.client.SAdd(ctx, key, members...)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+func (p *fakeOwnerIndexPipeliner) Expire(ctx context.Context, key string, ttl time.Duration) *redis.BoolCmd {
+	cmd := p.client.Expire(ctx, key, ttl)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+func (p *fakeOwnerIndexPipeliner) Exec(ctx context.Context) ([]redis.Cmder, error) {
+	return p.cmds, nil
+}
+
+func newTestOwnerIndexCache() (*ConversationRedisCache, *fakeOwnerIndexStore) {
+	store := newFakeOwnerIndexStore()
+	return &ConversationRedisCache{rdb: &fakeOwnerIndexClient{store: store}, expireTime: time.Minute}, store
+}
+
+func TestAddConversationOwnerIndexAddsMemberAndRefreshesTTL(t *testing.T) {
+	ctx := context.Background()
+	c, store := newTestOwnerIndexCache()
+
+	if err := c.addConversationOwnerIndex(ctx, "conv1", "u1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	members := store.members(c.getConversationOwnersKey("conv1"))
+	if len(members) != 1 || members[0] != "u1" {
+		t.Fatalf("unexpected members: %v", members)
+	}
+	if store.ttl[c.getConversationOwnersKey("conv1")] != c.expireTime {
+		t.Fatalf("expected index ttl to be refreshed to expireTime")
+	}
+}
+
+func TestRemoveConversationOwnerIndexRemovesStaleOwnerOnly(t *testing.T) {
+	ctx := context.Background()
+	c, store := newTestOwnerIndexCache()
+
+	if err := c.addConversationOwnerIndex(ctx, "conv1", "u1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.addConversationOwnerIndex(ctx, "conv1", "u2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := c.removeConversationOwnerIndex(ctx, "conv1", "u1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	members := store.members(c.getConversationOwnersKey("conv1"))
+	if len(members) != 1 || members[0] != "u2" {
+		t.Fatalf("expected only u2 left in the index, got %v", members)
+	}
+}
+
+func TestAddConversationOwnerIndexBatchAddsEveryConversation(t *testing.T) {
+	ctx := context.Background()
+	c, store := newTestOwnerIndexCache()
+
+	if err := c.addConversationOwnerIndexBatch(ctx, "u1", []string{"conv1", "conv2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, conversationID := range []string{"conv1", "conv2"} {
+		members := store.members(c.getConversationOwnersKey(conversationID))
+		if len(members) != 1 || members[0] != "u1" {
+			t.Fatalf("unexpected members for %s: %v", conversationID, members)
+		}
+	}
+}
+
+func TestAddConversationOwnerIndexBatchNoopOnEmptyInput(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestOwnerIndexCache()
+
+	if err := c.addConversationOwnerIndexBatch(ctx, "u1", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}